@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadRecord is the sidecar metadata persisted alongside every
+// content-addressed EPUB as "<sha256>.json".
+type uploadRecord struct {
+	SHA256         string    `json:"sha256"`
+	Filename       string    `json:"filename"`
+	UploadedAt     time.Time `json:"uploaded_at"`
+	Size           int64     `json:"size"`
+	UploadedBy     string    `json:"uploaded_by"`
+	Subdir         string    `json:"subdir,omitempty"`
+	Deduplicated   bool      `json:"deduplicated"`
+}
+
+// epubObjectName returns the storage key for this record's EPUB content,
+// qualified by its owning key's subdir (if any).
+func (r *uploadRecord) epubObjectName() string {
+	return path.Join(r.Subdir, r.SHA256+".epub")
+}
+
+// metaObjectName returns the storage key for this record's JSON sidecar.
+func (r *uploadRecord) metaObjectName() string {
+	return path.Join(r.Subdir, r.SHA256+".json")
+}
+
+// storeContentAddressed hashes r with SHA-256 as it is staged to a local
+// temp file, then commits it to uploader as "<sha256>.epub" with a
+// "<sha256>.json" metadata sidecar. If that hash already exists, the
+// staged copy is discarded and the existing record is returned instead,
+// making retried uploads idempotent.
+func storeContentAddressed(ctx context.Context, uploader Uploader, r io.Reader, filename, uploadedBy, digestHeader, subdir string) (*uploadRecord, error) {
+	tempFile, err := os.CreateTemp("", "epub-receiver-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage upload: %w", err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(tempFile, io.TeeReader(r, hasher))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage upload: %w", err)
+	}
+	sum := hasher.Sum(nil)
+
+	if digestHeader != "" {
+		if err := verifyDigestHeader(digestHeader, sum); err != nil {
+			return nil, err
+		}
+	}
+
+	record := &uploadRecord{
+		SHA256:         hex.EncodeToString(sum),
+		Filename:       filepath.Base(filename),
+		UploadedAt:     time.Now(),
+		Size:           size,
+		UploadedBy:     uploadedBy,
+		Subdir:         subdir,
+	}
+
+	if existing, err := loadUploadRecord(ctx, uploader, record.metaObjectName()); err == nil {
+		existing.Deduplicated = true
+		return existing, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to stage upload: %w", err)
+	}
+	if _, err := uploader.Put(ctx, record.epubObjectName(), tempFile, size); err != nil {
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upload record: %w", err)
+	}
+	if _, err := uploader.Put(ctx, record.metaObjectName(), bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("failed to store upload record: %w", err)
+	}
+
+	return record, nil
+}
+
+func loadUploadRecord(ctx context.Context, uploader Uploader, metaName string) (*uploadRecord, error) {
+	rc, err := uploader.Open(ctx, metaName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var record uploadRecord
+	if err := json.NewDecoder(rc).Decode(&record); err != nil {
+		return nil, fmt.Errorf("failed to decode existing upload record: %w", err)
+	}
+	return &record, nil
+}
+
+// digestMismatchError marks a bad Digest header as a client error (400)
+// rather than an internal storage failure (500).
+type digestMismatchError struct{ reason string }
+
+func (e *digestMismatchError) Error() string { return e.reason }
+
+// verifyDigestHeader checks a "Digest: sha-256=<base64>" request header
+// against the SHA-256 computed while staging the upload.
+func verifyDigestHeader(header string, sum []byte) error {
+	parts := strings.SplitN(header, "=", 2)
+	if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), "sha-256") {
+		return &digestMismatchError{fmt.Sprintf("unsupported Digest header %q", header)}
+	}
+	want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return &digestMismatchError{"invalid Digest header encoding"}
+	}
+	if !bytes.Equal(want, sum) {
+		return &digestMismatchError{"Digest header does not match uploaded content"}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// epubMimetypeHeaderSize is generous enough to cover the fixed 30-byte ZIP
+// local file header plus the "mimetype" filename and its short content,
+// without ever needing to buffer more than one read's worth of bytes.
+const epubMimetypeHeaderSize = 128
+
+// zip local file header layout (ZIP spec, section 4.3.7)
+const (
+	zipLocalHeaderFixedSize  = 30
+	zipCompressedSizeOffset  = 18
+	zipFilenameLengthOffset  = 26
+	zipExtraFieldLenOffset   = 28
+)
+
+// validateEPUBStream peeks at the start of r to confirm it is a well-formed
+// EPUB container: a ZIP archive (PK\x03\x04 magic) whose first entry is an
+// uncompressed "mimetype" file containing "application/epub+zip", per the
+// EPUB OCF spec. It returns a reader that reproduces the full stream
+// (peeked bytes included) so the caller can still stream the rest to disk.
+func validateEPUBStream(r io.Reader) (io.Reader, error) {
+	header := make([]byte, epubMimetypeHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read EPUB header: %w", err)
+	}
+	header = header[:n]
+
+	if err := checkEPUBHeaderBytes(header); err != nil {
+		return nil, err
+	}
+
+	return io.MultiReader(bytes.NewReader(header), r), nil
+}
+
+// checkEPUBHeaderBytes validates a buffer containing (at least) the start
+// of a candidate EPUB file against the ZIP magic and OCF mimetype rule.
+func checkEPUBHeaderBytes(header []byte) error {
+	if len(header) < 4 || !bytes.Equal(header[:4], []byte("PK\x03\x04")) {
+		return fmt.Errorf("not a valid EPUB: missing ZIP magic bytes")
+	}
+	if len(header) < zipLocalHeaderFixedSize {
+		return fmt.Errorf("not a valid EPUB: file too small")
+	}
+
+	compressedSize := binary.LittleEndian.Uint32(header[zipCompressedSizeOffset:])
+	filenameLen := binary.LittleEndian.Uint16(header[zipFilenameLengthOffset:])
+	extraLen := binary.LittleEndian.Uint16(header[zipExtraFieldLenOffset:])
+
+	nameStart := zipLocalHeaderFixedSize
+	nameEnd := nameStart + int(filenameLen)
+	if len(header) < nameEnd {
+		return fmt.Errorf("not a valid EPUB: truncated mimetype entry")
+	}
+	if string(header[nameStart:nameEnd]) != "mimetype" {
+		return fmt.Errorf("not a valid EPUB: first ZIP entry must be 'mimetype'")
+	}
+
+	dataStart := nameEnd + int(extraLen)
+	dataEnd := dataStart + int(compressedSize)
+	if len(header) < dataEnd {
+		return fmt.Errorf("not a valid EPUB: truncated mimetype content")
+	}
+	if string(header[dataStart:dataEnd]) != "application/epub+zip" {
+		return fmt.Errorf("not a valid EPUB: mimetype entry must be 'application/epub+zip'")
+	}
+
+	return nil
+}
+
+// checkEPUBMagicBytes validates an already-written file on disk, used by
+// the tus completion path where the data is no longer a live stream.
+func checkEPUBMagicBytes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, epubMimetypeHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return checkEPUBHeaderBytes(header[:n])
+}
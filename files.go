@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileIndex is an in-memory cache of the uploadRecord sidecars backing
+// every stored EPUB, rebuilt from the storage backend on write/delete so
+// listing requests don't have to walk the backend on every call.
+type fileIndex struct {
+	uploader Uploader
+
+	mu      sync.RWMutex
+	records []uploadRecord
+}
+
+func newFileIndex(uploader Uploader) *fileIndex {
+	idx := &fileIndex{uploader: uploader}
+	if err := idx.refresh(context.Background()); err != nil {
+		log.Printf("Failed to build initial file index: %v", err)
+	}
+	return idx
+}
+
+// refresh rebuilds the index by listing every "<sha256>.json" sidecar in
+// the storage backend, mirroring how a static-file server periodically
+// rebuilds its directory index.
+func (idx *fileIndex) refresh(ctx context.Context) error {
+	entries, err := idx.uploader.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list storage backend: %w", err)
+	}
+
+	records := make([]uploadRecord, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, ".json") {
+			continue
+		}
+		record, err := loadUploadRecord(ctx, idx.uploader, entry.Name)
+		if err != nil {
+			log.Printf("Failed to read upload record %s: %v", entry.Name, err)
+			continue
+		}
+		if record.SHA256 == "" {
+			// Not a real uploadRecord sidecar — e.g. a tus.io upload
+			// sidecar (tusUpload), which shares the "filename"/"subdir"
+			// JSON field names but has no sha256, decodes without error.
+			continue
+		}
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].UploadedAt.After(records[j].UploadedAt) })
+
+	idx.mu.Lock()
+	idx.records = records
+	idx.mu.Unlock()
+	return nil
+}
+
+func (idx *fileIndex) snapshot() []uploadRecord {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	records := make([]uploadRecord, len(idx.records))
+	copy(records, idx.records)
+	return records
+}
+
+// snapshotForSubdir returns only the records belonging to subdir, so one
+// tenant's listing never exposes another tenant's files.
+func (idx *fileIndex) snapshotForSubdir(subdir string) []uploadRecord {
+	records := idx.snapshot()
+	filtered := records[:0]
+	for _, record := range records {
+		if record.Subdir == subdir {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+func (idx *fileIndex) findByFilename(subdir, name string) (uploadRecord, bool) {
+	for _, record := range idx.snapshotForSubdir(subdir) {
+		if record.Filename == name {
+			return record, true
+		}
+	}
+	return uploadRecord{}, false
+}
+
+// filesListHandlerWithKey serves GET /files: a JSON listing of stored
+// EPUBs with optional ?q= substring filtering and ?limit=&offset= paging.
+func filesListHandlerWithKey(store *KeyStore, idx *fileIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, keyConfig, ok := authenticate(r, store)
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		records := idx.snapshotForSubdir(keyConfig.Subdir)
+
+		if q := r.URL.Query().Get("q"); q != "" {
+			filtered := records[:0]
+			for _, record := range records {
+				if strings.Contains(strings.ToLower(record.Filename), strings.ToLower(q)) {
+					filtered = append(filtered, record)
+				}
+			}
+			records = filtered
+		}
+
+		offset := parseNonNegativeInt(r.URL.Query().Get("offset"), 0)
+		limit := parseNonNegativeInt(r.URL.Query().Get("limit"), len(records))
+		if offset > len(records) {
+			offset = len(records)
+		}
+		end := offset + limit
+		if end > len(records) {
+			end = len(records)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(records[offset:end])
+	}
+}
+
+// fileItemHandlerWithKey serves GET and DELETE for /files/{name}, where
+// {name} is the human-readable filename shown by the listing endpoint.
+func fileItemHandlerWithKey(store *KeyStore, uploader Uploader, idx *fileIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, keyConfig, ok := authenticate(r, store)
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/files/")
+		if name == "" {
+			http.Error(w, "Missing file name", http.StatusBadRequest)
+			return
+		}
+
+		record, ok := idx.findByFilename(keyConfig.Subdir, name)
+		if !ok {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			downloadFile(w, r, uploader, record)
+		case http.MethodDelete:
+			deleteFile(w, r, uploader, idx, record)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func downloadFile(w http.ResponseWriter, r *http.Request, uploader Uploader, record uploadRecord) {
+	rc, err := uploader.Open(r.Context(), record.epubObjectName())
+	if err != nil {
+		log.Printf("Failed to open %s for download: %v", record.Filename, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/epub+zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, record.Filename))
+	w.Header().Set("Content-Length", strconv.FormatInt(record.Size, 10))
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("Failed to stream %s to client: %v", record.Filename, err)
+	}
+}
+
+func deleteFile(w http.ResponseWriter, r *http.Request, uploader Uploader, idx *fileIndex, record uploadRecord) {
+	if err := uploader.Delete(r.Context(), record.epubObjectName()); err != nil {
+		log.Printf("Failed to delete %s: %v", record.Filename, err)
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	if err := uploader.Delete(r.Context(), record.metaObjectName()); err != nil {
+		log.Printf("Failed to delete upload record for %s: %v", record.Filename, err)
+	}
+
+	if err := idx.refresh(r.Context()); err != nil {
+		log.Printf("Failed to refresh file index after delete: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseNonNegativeInt parses s as a non-negative int, returning fallback
+// on empty input or a malformed/negative value.
+func parseNonNegativeInt(s string, fallback int) int {
+	if s == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// APIKeyConfig describes one tenant sharing this receiver: a display
+// name for logs, an optional total-storage quota, an optional upload
+// rate limit, and the subdirectory its files are stored under.
+type APIKeyConfig struct {
+	Name          string `json:"name"`
+	QuotaBytes    int64  `json:"quota_bytes"`
+	RatePerMinute int    `json:"rate_per_minute"`
+	Subdir        string `json:"subdir"`
+}
+
+// KeyStore resolves request API keys to their tenant configuration.
+type KeyStore struct {
+	keys map[string]APIKeyConfig
+}
+
+// loadKeyStore builds a KeyStore from, in order of precedence:
+// API_KEYS_JSON (an inline JSON object mapping key -> config), an
+// API_KEYS_FILE path to the same JSON shape, or a single legacy API_KEY
+// env var treated as one unlimited, root-level tenant.
+func loadKeyStore() (*KeyStore, error) {
+	if raw := os.Getenv("API_KEYS_JSON"); raw != "" {
+		keys, err := parseAPIKeysJSON([]byte(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_KEYS_JSON: %w", err)
+		}
+		return &KeyStore{keys: keys}, nil
+	}
+
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API_KEYS_FILE: %w", err)
+		}
+		keys, err := parseAPIKeysJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_KEYS_FILE: %w", err)
+		}
+		return &KeyStore{keys: keys}, nil
+	}
+
+	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+		return &KeyStore{keys: map[string]APIKeyConfig{
+			apiKey: {Name: "default"},
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("one of API_KEYS_JSON, API_KEYS_FILE, or API_KEY is required")
+}
+
+func parseAPIKeysJSON(data []byte) (map[string]APIKeyConfig, error) {
+	var keys map[string]APIKeyConfig
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for key, cfg := range keys {
+		if cfg.Name == "" {
+			cfg.Name = maskAPIKey(key)
+			keys[key] = cfg
+		}
+	}
+	return keys, nil
+}
+
+// Lookup returns the tenant config for an API key, if any.
+func (s *KeyStore) Lookup(apiKey string) (APIKeyConfig, bool) {
+	cfg, ok := s.keys[apiKey]
+	return cfg, ok
+}
+
+// authenticate validates the api_key query parameter against store and
+// returns the raw key and its tenant config.
+func authenticate(r *http.Request, store *KeyStore) (string, APIKeyConfig, bool) {
+	apiKey := r.URL.Query().Get("api_key")
+	if apiKey == "" {
+		return "", APIKeyConfig{}, false
+	}
+	cfg, ok := store.Lookup(apiKey)
+	return apiKey, cfg, ok
+}
+
+// tokenBucket is a simple per-key rate limiter: it refills at
+// ratePerMinute tokens/minute up to that same burst capacity.
+type tokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	capacity   float64
+	refillRate float64 // tokens per second
+	lastRefill time.Time
+}
+
+// RateLimiter hands out a token bucket per API key, so each tenant is
+// limited independently on /upload.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow reports whether a request for apiKey may proceed under its
+// ratePerMinute limit. A ratePerMinute of 0 means unlimited.
+func (rl *RateLimiter) Allow(apiKey string, ratePerMinute int) bool {
+	if ratePerMinute <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	bucket, ok := rl.buckets[apiKey]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens:     float64(ratePerMinute),
+			capacity:   float64(ratePerMinute),
+			refillRate: float64(ratePerMinute) / 60,
+			lastRefill: time.Now(),
+		}
+		rl.buckets[apiKey] = bucket
+	}
+	rl.mu.Unlock()
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	bucket.tokens += elapsed * bucket.refillRate
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
-	"time"
 )
 
 const (
@@ -17,10 +17,10 @@ const (
 )
 
 func main() {
-	// Get API key from environment
-	apiKey := os.Getenv("API_KEY")
-	if apiKey == "" {
-		log.Fatal("API_KEY environment variable is required")
+	// Load the API key(s) and their per-tenant configuration
+	keyStore, err := loadKeyStore()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Create upload directory if it doesn't exist
@@ -28,8 +28,22 @@ func main() {
 		log.Fatal("Failed to create upload directory:", err)
 	}
 
-	// Pass API key to handlers via closure
-	http.HandleFunc("/upload", uploadHandlerWithKey(apiKey))
+	// Select the storage backend from STORAGE_DRIVER/STORAGE_SOURCE,
+	// defaulting to the local filesystem under UPLOAD_DIR.
+	uploader, err := NewUploader(os.Getenv("STORAGE_DRIVER"), os.Getenv("STORAGE_SOURCE"))
+	if err != nil {
+		log.Fatal("Failed to initialize storage backend:", err)
+	}
+
+	fileIdx := newFileIndex(uploader)
+	limiter := newRateLimiter()
+
+	// Pass shared state to handlers via closure
+	http.HandleFunc("/upload", uploadHandlerWithKey(keyStore, limiter, uploader, fileIdx))
+	http.HandleFunc("/uploads/", tusHandlerWithKey(keyStore, limiter, uploader, fileIdx))
+	http.HandleFunc("/files", filesListHandlerWithKey(keyStore, fileIdx))
+	http.HandleFunc("/files/", fileItemHandlerWithKey(keyStore, uploader, fileIdx))
+	http.HandleFunc("/usage", usageHandlerWithKey(keyStore, uploader))
 	http.HandleFunc("/health", healthHandler)
 
 	port := os.Getenv("PORT")
@@ -39,81 +53,156 @@ func main() {
 
 	log.Printf("Server starting on port %s", port)
 	log.Printf("Upload directory: %s", UPLOAD_DIR)
-	log.Printf("API key configured: %s", maskAPIKey(apiKey))
+	log.Printf("%d API key(s) configured", len(keyStore.keys))
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
-func uploadHandlerWithKey(apiKey string) http.HandlerFunc {
+func uploadHandlerWithKey(store *KeyStore, limiter *RateLimiter, uploader Uploader, idx *fileIndex) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		uploadHandler(w, r, apiKey)
+		uploadHandler(w, r, store, limiter, uploader, idx)
 	}
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request, apiKey string) {
+func uploadHandler(w http.ResponseWriter, r *http.Request, store *KeyStore, limiter *RateLimiter, uploader Uploader, idx *fileIndex) {
 	// Only allow POST requests
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Validate API key from query parameters
-	requestAPIKey := r.URL.Query().Get("api_key")
-	if requestAPIKey != apiKey {
+	// Validate the API key and look up its tenant configuration
+	apiKey, keyConfig, ok := authenticate(r, store)
+	if !ok {
 		http.Error(w, "Invalid API key", http.StatusUnauthorized)
 		return
 	}
 
-	// Parse multipart form with size limit
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_FILE_SIZE)
-	if err := r.ParseMultipartForm(MAX_FILE_SIZE); err != nil {
-		http.Error(w, "File too large or invalid form", http.StatusBadRequest)
+	if !limiter.Allow(apiKey, keyConfig.RatePerMinute) {
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
 
-	// Get the uploaded file
-	file, header, err := r.FormFile("epub")
-	if err != nil {
-		http.Error(w, "Failed to get uploaded file", http.StatusBadRequest)
-		return
+	var usedBeforeUpload int64
+	if keyConfig.QuotaBytes > 0 {
+		used, err := usageBytes(r.Context(), uploader, keyConfig.Subdir)
+		if err != nil {
+			log.Printf("Failed to compute usage for %s: %v", keyConfig.Name, err)
+			http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+			return
+		}
+		usedBeforeUpload = used
+
+		// r.ContentLength is -1 for chunked requests, so it can't be
+		// trusted as the upload size; fall back to MAX_FILE_SIZE, the
+		// largest the upload could possibly be, for this pre-check.
+		declaredSize := r.ContentLength
+		if declaredSize <= 0 {
+			declaredSize = MAX_FILE_SIZE
+		}
+		if used+declaredSize > keyConfig.QuotaBytes {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
 	}
-	defer file.Close()
 
-	// Validate file extension
-	filename := header.Filename
-	if !strings.HasSuffix(strings.ToLower(filename), ".epub") {
-		http.Error(w, "File must be an EPUB", http.StatusBadRequest)
-		return
-	}
-
-	// Generate unique filename with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	safeFilename := fmt.Sprintf("%s_%s", timestamp, filepath.Base(filename))
-	destPath := filepath.Join(UPLOAD_DIR, safeFilename)
-
-	// Create destination file
-	destFile, err := os.Create(destPath)
+	// Stream the multipart body part-by-part so a large EPUB is never
+	// buffered in memory or spilled to a temp file by mime/multipart.
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_FILE_SIZE)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		log.Printf("Failed to create destination file: %v", err)
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		http.Error(w, "Invalid multipart form", http.StatusBadRequest)
 		return
 	}
-	defer destFile.Close()
 
-	// Copy uploaded file to destination
-	bytesWritten, err := io.Copy(destFile, file)
-	if err != nil {
-		log.Printf("Failed to copy file: %v", err)
-		os.Remove(destPath) // Clean up partial file
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+	var filename string
+	var found bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "epub" {
+			part.Close()
+			continue
+		}
+
+		filename = part.FileName()
+		if !strings.HasSuffix(strings.ToLower(filename), ".epub") {
+			part.Close()
+			http.Error(w, "File must be an EPUB", http.StatusBadRequest)
+			return
+		}
+
+		validated, err := validateEPUBStream(part)
+		if err != nil {
+			part.Close()
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		record, err := storeContentAddressed(r.Context(), uploader, validated, filename, keyConfig.Name, r.Header.Get("Digest"), keyConfig.Subdir)
+		part.Close()
+		if err != nil {
+			var mismatch *digestMismatchError
+			if errors.As(err, &mismatch) {
+				http.Error(w, mismatch.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to store file: %v", err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+
+		// A deduplicated upload adds nothing to usage, but a new file's
+		// real size (as opposed to the declared Content-Length, which a
+		// chunked request can omit or understate) might still push the
+		// tenant over quota; reject and remove it if so.
+		if !record.Deduplicated && keyConfig.QuotaBytes > 0 && usedBeforeUpload+record.Size > keyConfig.QuotaBytes {
+			if err := uploader.Delete(r.Context(), record.epubObjectName()); err != nil {
+				log.Printf("Failed to delete over-quota upload %s: %v", filename, err)
+			}
+			if err := uploader.Delete(r.Context(), record.metaObjectName()); err != nil {
+				log.Printf("Failed to delete over-quota upload record %s: %v", filename, err)
+			}
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if record.Deduplicated {
+			log.Printf("Deduplicated EPUB upload by %s: %s (sha256 %s already stored)", keyConfig.Name, filename, record.SHA256)
+		} else {
+			log.Printf("Successfully uploaded EPUB by %s: %s (%d bytes, sha256 %s)", keyConfig.Name, filename, record.Size, record.SHA256)
+			if err := idx.refresh(r.Context()); err != nil {
+				log.Printf("Failed to refresh file index: %v", err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Status       string `json:"status"`
+			Filename     string `json:"filename"`
+			Size         int64  `json:"size"`
+			SHA256       string `json:"sha256"`
+			Deduplicated bool   `json:"deduplicated"`
+		}{
+			Status:       "success",
+			Filename:     record.Filename,
+			Size:         record.Size,
+			SHA256:       record.SHA256,
+			Deduplicated: record.Deduplicated,
+		})
+		found = true
+		break
 	}
 
-	log.Printf("Successfully uploaded EPUB: %s (%d bytes)", safeFilename, bytesWritten)
-
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status": "success", "filename": "%s", "size": %d}`, safeFilename, bytesWritten)
+	if !found {
+		http.Error(w, "Failed to get uploaded file", http.StatusBadRequest)
+	}
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tusResumableVersion = "1.0.0"
+	tusDir              = ".tus"
+
+	// tusUploadTTL bounds how long an unfinished tus upload's reserved
+	// space counts against its tenant's quota before it's reaped as
+	// abandoned, so a client can't permanently pin quota by never
+	// finishing an upload.
+	tusUploadTTL = 24 * time.Hour
+)
+
+// tusUpload is the metadata sidecar persisted alongside each in-progress
+// upload so a server restart doesn't lose track of partially received files.
+// APIKey/KeyName/Subdir pin the upload to the tenant that created it, since
+// PATCH requests arrive as separate HTTP requests that must not be allowed
+// to complete or extend another tenant's upload.
+type tusUpload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"created_at"`
+	APIKey    string    `json:"api_key"`
+	KeyName   string    `json:"key_name"`
+	Subdir    string    `json:"subdir,omitempty"`
+}
+
+func (u *tusUpload) dataPath() string {
+	return filepath.Join(UPLOAD_DIR, tusDir, u.ID)
+}
+
+func (u *tusUpload) metaPath() string {
+	return filepath.Join(UPLOAD_DIR, tusDir, u.ID+".json")
+}
+
+func (u *tusUpload) save() error {
+	f, err := os.Create(u.metaPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(u)
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	f, err := os.Open(filepath.Join(UPLOAD_DIR, tusDir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var u tusUpload
+	if err := json.NewDecoder(f).Decode(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// tusHandlerWithKey wires the tus.io resumable upload endpoints in behind
+// the same api_key check, rate limiter, storage backend, and file index
+// used by the regular /upload handler, so a tus upload gets the same
+// tenant isolation, quota, and dedup guarantees.
+func tusHandlerWithKey(store *KeyStore, limiter *RateLimiter, uploader Uploader, idx *fileIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey, keyConfig, ok := authenticate(r, store)
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		tusHandler(w, r, apiKey, keyConfig, limiter, uploader, idx)
+	}
+}
+
+func tusHandler(w http.ResponseWriter, r *http.Request, apiKey string, keyConfig APIKeyConfig, limiter *RateLimiter, uploader Uploader, idx *fileIndex) {
+	w.Header().Set("Tus-Resumable", tusResumableVersion)
+
+	switch r.Method {
+	case http.MethodOptions:
+		tusOptionsHandler(w, r)
+	case http.MethodPost:
+		tusCreateHandler(w, r, apiKey, keyConfig, limiter, uploader)
+	case http.MethodHead:
+		tusHeadHandler(w, r, apiKey)
+	case http.MethodPatch:
+		tusPatchHandler(w, r, apiKey, keyConfig, limiter, uploader, idx)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusResumableVersion)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(MAX_FILE_SIZE))
+	w.Header().Set("Tus-Extension", "creation")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusCreateHandler(w http.ResponseWriter, r *http.Request, apiKey string, keyConfig APIKeyConfig, limiter *RateLimiter, uploader Uploader) {
+	if r.Header.Get("Tus-Resumable") != tusResumableVersion {
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	if !limiter.Allow(apiKey, keyConfig.RatePerMinute) {
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > MAX_FILE_SIZE {
+		http.Error(w, "Upload exceeds maximum file size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if keyConfig.QuotaBytes > 0 {
+		used, err := usageBytes(r.Context(), uploader, keyConfig.Subdir)
+		if err != nil {
+			log.Printf("Failed to compute usage for %s: %v", keyConfig.Name, err)
+			http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+			return
+		}
+		reserved, err := reservedTusBytes(keyConfig.Subdir)
+		if err != nil {
+			log.Printf("Failed to compute in-flight tus reservations for %s: %v", keyConfig.Name, err)
+			http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+			return
+		}
+		if used+reserved+length > keyConfig.QuotaBytes {
+			http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(UPLOAD_DIR, tusDir), 0755); err != nil {
+		log.Printf("Failed to create tus upload directory: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		log.Printf("Failed to generate upload ID: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	upload := &tusUpload{
+		ID:        uploadID,
+		Filename:  uploadMetadataFilename(r),
+		Length:    length,
+		Offset:    0,
+		CreatedAt: time.Now(),
+		APIKey:    apiKey,
+		KeyName:   keyConfig.Name,
+		Subdir:    keyConfig.Subdir,
+	}
+
+	// Pre-allocate a sparse file so PATCH requests can write at arbitrary offsets.
+	f, err := os.Create(upload.dataPath())
+	if err != nil {
+		log.Printf("Failed to create upload file: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := f.Truncate(length); err != nil {
+		f.Close()
+		os.Remove(upload.dataPath())
+		log.Printf("Failed to allocate upload file: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := upload.save(); err != nil {
+		log.Printf("Failed to persist upload metadata: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/uploads/%s", upload.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHeadHandler(w http.ResponseWriter, r *http.Request, apiKey string) {
+	upload, err := loadTusUpload(tusUploadID(r))
+	if err != nil || upload.APIKey != apiKey {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatchHandler(w http.ResponseWriter, r *http.Request, apiKey string, keyConfig APIKeyConfig, limiter *RateLimiter, uploader Uploader, idx *fileIndex) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := loadTusUpload(tusUploadID(r))
+	if err != nil || upload.APIKey != apiKey {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if !limiter.Allow(apiKey, keyConfig.RatePerMinute) {
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(upload.dataPath(), os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open upload file: %v", err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, 0); err != nil {
+		log.Printf("Failed to seek upload file: %v", err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, upload.Length-offset)
+	written, err := io.Copy(f, r.Body)
+	if err != nil {
+		log.Printf("Failed to write upload chunk: %v", err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	upload.Offset += written
+	if err := upload.save(); err != nil {
+		log.Printf("Failed to persist upload metadata: %v", err)
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if upload.Offset == upload.Length {
+		if err := finishTusUpload(r.Context(), uploader, idx, upload); err != nil {
+			log.Printf("Failed to finalize upload %s: %v", upload.ID, err)
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload validates the completed file and hands it to
+// storeContentAddressed, the same content-addressed storage, dedup, and
+// sidecar path that uploadHandler uses, so a tus upload ends up in the
+// configured storage backend and the file index instead of always landing
+// on local disk.
+func finishTusUpload(ctx context.Context, uploader Uploader, idx *fileIndex, upload *tusUpload) error {
+	if !strings.HasSuffix(strings.ToLower(upload.Filename), ".epub") {
+		cleanupTusUpload(upload)
+		return fmt.Errorf("file must be an EPUB")
+	}
+	if err := checkEPUBMagicBytes(upload.dataPath()); err != nil {
+		cleanupTusUpload(upload)
+		return err
+	}
+
+	f, err := os.Open(upload.dataPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	record, err := storeContentAddressed(ctx, uploader, f, upload.Filename, upload.KeyName, "", upload.Subdir)
+	if err != nil {
+		cleanupTusUpload(upload)
+		return err
+	}
+	cleanupTusUpload(upload)
+
+	if err := idx.refresh(ctx); err != nil {
+		log.Printf("Failed to refresh file index after tus upload: %v", err)
+	}
+
+	if record.Deduplicated {
+		log.Printf("Deduplicated tus EPUB upload by %s: %s (sha256 %s already stored)", upload.KeyName, upload.Filename, record.SHA256)
+	} else {
+		log.Printf("Completed tus upload by %s: %s (%d bytes, sha256 %s)", upload.KeyName, upload.Filename, record.Size, record.SHA256)
+	}
+	return nil
+}
+
+// reservedTusBytes sums the Upload-Length of every in-progress tus upload
+// belonging to subdir, so a tenant can't evade its quota by opening many
+// uploads and never finishing them. As a side effect it reaps any upload
+// older than tusUploadTTL, freeing the disk space and quota it pinned.
+func reservedTusBytes(subdir string) (int64, error) {
+	entries, err := os.ReadDir(filepath.Join(UPLOAD_DIR, tusDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var total int64
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		upload, err := loadTusUpload(id)
+		if err != nil {
+			continue
+		}
+		if now.Sub(upload.CreatedAt) > tusUploadTTL {
+			log.Printf("Reaping abandoned tus upload %s (%s)", upload.ID, upload.Filename)
+			cleanupTusUpload(upload)
+			continue
+		}
+		if upload.Subdir == subdir {
+			total += upload.Length
+		}
+	}
+	return total, nil
+}
+
+func cleanupTusUpload(upload *tusUpload) {
+	os.Remove(upload.dataPath())
+	os.Remove(upload.metaPath())
+}
+
+// newUploadID returns a random 16-byte hex identifier for a new tus upload.
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// tusUploadID extracts the upload ID from a /uploads/<id> request path.
+func tusUploadID(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/uploads/")
+}
+
+// uploadMetadataFilename pulls the original filename out of the tus
+// Upload-Metadata header (base64-encoded key/value pairs), falling back to
+// a generic name if the client didn't send one.
+func uploadMetadataFilename(r *http.Request) string {
+	for _, pair := range strings.Split(r.Header.Get("Upload-Metadata"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if len(parts) == 2 && parts[0] == "filename" {
+			if decoded, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+				return string(decoded)
+			}
+		}
+	}
+	return "upload.epub"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// usageBytes sums the size of every stored EPUB under subdir, used both
+// to enforce a key's quota and to answer GET /usage.
+func usageBytes(ctx context.Context, uploader Uploader, subdir string) (int64, error) {
+	entries, err := uploader.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, ".epub") {
+			continue
+		}
+		if subdir == "" {
+			// Root-level files only: anything with a "/" belongs to some
+			// tenant's subdir, not the root tenant.
+			if strings.Contains(entry.Name, "/") {
+				continue
+			}
+		} else if !strings.HasPrefix(entry.Name, subdir+"/") {
+			continue
+		}
+		total += entry.Size
+	}
+	return total, nil
+}
+
+// usageHandlerWithKey serves GET /usage: the requesting key's current
+// storage usage against its quota.
+func usageHandlerWithKey(store *KeyStore, uploader Uploader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, cfg, ok := authenticate(r, store)
+		if !ok {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		used, err := usageBytes(r.Context(), uploader, cfg.Subdir)
+		if err != nil {
+			http.Error(w, "Failed to compute usage", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Name          string `json:"name"`
+			UsedBytes     int64  `json:"used_bytes"`
+			QuotaBytes    int64  `json:"quota_bytes"`
+			RatePerMinute int    `json:"rate_per_minute"`
+		}{
+			Name:          cfg.Name,
+			UsedBytes:     used,
+			QuotaBytes:    cfg.QuotaBytes,
+			RatePerMinute: cfg.RatePerMinute,
+		})
+	}
+}